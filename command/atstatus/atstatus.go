@@ -0,0 +1,60 @@
+// Package atstatus registers the ">at" command, a worked example of an
+// out-of-tree-style command: it fetches a small JSON status endpoint (in
+// the style of the "checkinator" conference check-in tool) and formats a
+// one-line summary. Importing this package for its side effect (init)
+// registers the command; the main binary doesn't otherwise depend on it.
+package atstatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/stapelberg/go-buildbot-announce/command"
+)
+
+// StatusURL is the JSON status endpoint queried by ">at". It can be
+// overridden before main() runs, e.g. from a config flag.
+var StatusURL = "https://check.i3wm.org/status.json"
+
+// status mirrors the small subset of the checkinator JSON response we
+// care about.
+type status struct {
+	CheckedIn int    `json:"checked_in"`
+	Total     int    `json:"total"`
+	Location  string `json:"location"`
+}
+
+func init() {
+	command.Register(command.Command{
+		Trigger: ">",
+		Name:    "at",
+		Help:    "Shows how many people are checked in at the current i3 hackathon/conference.",
+		Handle:  handle,
+	})
+}
+
+func handle(ctx context.Context, args string, reply func(string)) {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(StatusURL)
+	if err != nil {
+		reply(fmt.Sprintf("Could not reach %s: %v", StatusURL, err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply(fmt.Sprintf("%s returned status %d", StatusURL, resp.StatusCode))
+		return
+	}
+
+	var st status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		reply(fmt.Sprintf("Could not parse status from %s: %v", StatusURL, err))
+		return
+	}
+
+	reply(fmt.Sprintf("%d/%d checked in at %s", st.CheckedIn, st.Total, st.Location))
+}
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+// Version is the bot's version string, printed by ">source". main() can
+// override it (e.g. with a build-time git describe) before Commands run.
+var Version = "dev"
+
+// SourceURL is the repository printed by ">source".
+const SourceURL = "https://github.com/stapelberg/go-buildbot-announce"
+
+func init() {
+	handler.RegisterPlugin("command", func(cfg interface{}) handler.Handler {
+		return New()
+	})
+
+	Register(Command{
+		Trigger: ">",
+		Name:    "help",
+		Help:    "Lists every available command.",
+		Handle: func(ctx context.Context, args string, reply func(string)) {
+			for _, c := range All() {
+				reply(fmt.Sprintf("%s%s — %s", c.Trigger, c.Name, c.Help))
+			}
+		},
+	})
+
+	Register(Command{
+		Trigger: ">",
+		Name:    "source",
+		Help:    "Prints where my source code lives.",
+		Handle: func(ctx context.Context, args string, reply func(string)) {
+			reply(fmt.Sprintf("%s (%s)", SourceURL, Version))
+		},
+	})
+}
@@ -0,0 +1,209 @@
+// Package command implements a chat-command dispatcher: third parties
+// register a Command (a trigger prefix, a name, a help string and a
+// handler) and New returns a handler.Handler that recognizes and runs
+// them, rate-limited per nick. Internally it's built the same way
+// handler.Chain documents for any other Handler: a terminal Handler that
+// dispatches the matched Command, wrapped by Middleware that finds the
+// match and rate-limits it, communicating via context.Value like the
+// net/http middleware idiom handler mirrors.
+package command
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+// Command is a single chat command, e.g. ">help". Most commands are
+// recognized by an exact Trigger+Name prefix (see match); a command that
+// needs to recognize more than one invocation per line, or invocations
+// that aren't anchored to a fixed name (docref's ">userguide"-style
+// doc-file references, matched against a list that changes at runtime),
+// sets Scan instead of Trigger/Name.
+type Command struct {
+	// Trigger is the prefix that introduces this command, e.g. ">" or "!".
+	Trigger string
+	// Name is what follows Trigger, e.g. "help" for ">help".
+	Name string
+	// Help is shown by the built-in ">help" command.
+	Help string
+	// Handle runs the command. args is everything after the command name,
+	// with surrounding whitespace trimmed. reply sends a line back to
+	// whoever invoked the command.
+	Handle func(ctx context.Context, args string, reply func(string))
+
+	// Scan, if non-nil, is used instead of Trigger+Name prefix matching:
+	// it's called once per incoming line and returns the args for every
+	// invocation found in it. Handle is then called once per returned
+	// args string. A Command with Scan set should leave Trigger and Name
+	// empty.
+	Scan func(text string) (args []string)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Command
+)
+
+// Register makes c available to the dispatcher returned by New. It is
+// usually called from an init() function, mirroring handler.RegisterPlugin.
+func Register(c Command) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, &c)
+}
+
+// All returns every registered command, in registration order.
+func All() []*Command {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	out := make([]*Command, len(registry))
+	copy(out, registry)
+	return out
+}
+
+// match finds the Trigger+Name command text invokes, if any, and returns
+// it together with the trimmed argument string. Commands using Scan are
+// matched separately, by matchMiddleware calling Scan directly.
+func match(text string) (*Command, string, bool) {
+	text = strings.TrimSpace(text)
+	for _, c := range All() {
+		if c.Scan != nil {
+			continue
+		}
+		prefix := c.Trigger + c.Name
+		if !strings.HasPrefix(text, prefix) {
+			continue
+		}
+		rest := text[len(prefix):]
+		if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+			// e.g. ">helpful" shouldn't match the ">help" command.
+			continue
+		}
+		return c, strings.TrimSpace(rest), true
+	}
+	return nil, "", false
+}
+
+// invocation is the Command and arguments matchMiddleware found for an
+// Event, passed down the chain via context so dispatch doesn't need to
+// match again.
+type invocation struct {
+	cmd  *Command
+	args string
+}
+
+type invocationKey struct{}
+
+// matchMiddleware finds every Command invocation in ev.Text (Trigger+Name
+// commands match at most once per line; Scan commands may match several
+// times) and runs next once per invocation found, with the matched
+// Command and its arguments attached to ctx. Non-command messages never
+// reach next, so later middleware (rate limiting) only sees real
+// invocations.
+func matchMiddleware(next handler.Handler) handler.Handler {
+	return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+		if ev.Kind != handler.KindMessage {
+			return
+		}
+
+		for _, c := range All() {
+			if c.Scan == nil {
+				continue
+			}
+			for _, args := range c.Scan(ev.Text) {
+				next.Handle(context.WithValue(ctx, invocationKey{}, invocation{c, args}), w, ev)
+			}
+		}
+
+		if cmd, args, ok := match(ev.Text); ok {
+			next.Handle(context.WithValue(ctx, invocationKey{}, invocation{cmd, args}), w, ev)
+		}
+	})
+}
+
+// rateLimitMiddleware drops invocations once ev.Nick has exhausted its
+// token bucket, so a single user can't spam expensive commands (like
+// atstatus's HTTP fetch) or flood the channel via docref.
+func rateLimitMiddleware(l *limiter) handler.Middleware {
+	return func(next handler.Handler) handler.Handler {
+		return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+			inv, _ := ctx.Value(invocationKey{}).(invocation)
+			if !l.Allow(ev.Nick) {
+				log.Printf("command: rate-limiting %s%s from %s", inv.cmd.Trigger, inv.cmd.Name, ev.Nick)
+				return
+			}
+			next.Handle(ctx, w, ev)
+		})
+	}
+}
+
+// dispatch runs the invocation matchMiddleware attached to ctx, replying
+// via NOTICE for commands triggered in a channel (so we never trigger
+// another bot's auto-responder) and via PRIVMSG for ones triggered in a
+// private message.
+func dispatch(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+	inv, ok := ctx.Value(invocationKey{}).(invocation)
+	if !ok {
+		return
+	}
+	reply := w.Notice
+	if ev.Private {
+		reply = w.Send
+	}
+	inv.cmd.Handle(ctx, inv.args, reply)
+}
+
+// New returns a Handler that recognizes and runs registered commands,
+// built as a handler.Chain of matchMiddleware and rateLimitMiddleware
+// around dispatch.
+func New() handler.Handler {
+	limiter := newLimiter(1.0/3.0 /* tokens per second */, 3 /* burst */)
+	return handler.Chain(handler.HandlerFunc(dispatch), matchMiddleware, rateLimitMiddleware(limiter))
+}
+
+// limiter is a simple per-key token bucket.
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketState
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+}
+
+type bucketState struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate, burst float64) *limiter {
+	return &limiter{buckets: make(map[string]*bucketState), rate: rate, burst: burst}
+}
+
+func (l *limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucketState{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,179 @@
+package command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+func TestMatch(t *testing.T) {
+	registryMu.Lock()
+	saved := registry
+	registry = nil
+	registryMu.Unlock()
+	defer func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	}()
+
+	Register(Command{Trigger: ">", Name: "help"})
+
+	cases := []struct {
+		text     string
+		wantArgs string
+		wantOK   bool
+	}{
+		{">help", "", true},
+		{">help me", "me", true},
+		{"  >help  ", "", true},
+		{">helpful", "", false}, // ">help" shouldn't match ">helpful"
+		{"hello >help", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		cmd, args, ok := match(c.text)
+		if ok != c.wantOK {
+			t.Errorf("match(%q) ok = %v, want %v", c.text, ok, c.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if cmd.Name != "help" {
+			t.Errorf("match(%q) cmd.Name = %q, want %q", c.text, cmd.Name, "help")
+		}
+		if args != c.wantArgs {
+			t.Errorf("match(%q) args = %q, want %q", c.text, args, c.wantArgs)
+		}
+	}
+}
+
+func TestMatch_skipsScanCommands(t *testing.T) {
+	registryMu.Lock()
+	saved := registry
+	registry = nil
+	registryMu.Unlock()
+	defer func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	}()
+
+	Register(Command{Scan: func(string) []string { return nil }})
+
+	if _, _, ok := match(">anything"); ok {
+		t.Error("match() matched a Scan-only command")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1 /* token/s */, 3 /* burst */)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("nick") {
+			t.Fatalf("Allow() #%d = false, want true (within burst)", i)
+		}
+	}
+	if l.Allow("nick") {
+		t.Error("Allow() = true after exhausting the burst, want false")
+	}
+
+	// A different key has its own, unexhausted bucket.
+	if !l.Allow("other-nick") {
+		t.Error("Allow() for a different key = false, want true")
+	}
+}
+
+// fakeWriter records every line sent/noticed through it.
+type fakeWriter struct {
+	sent, noticed []string
+}
+
+func (w *fakeWriter) Send(line string)   { w.sent = append(w.sent, line) }
+func (w *fakeWriter) Notice(line string) { w.noticed = append(w.noticed, line) }
+
+func TestNew(t *testing.T) {
+	registryMu.Lock()
+	saved := registry
+	registry = nil
+	registryMu.Unlock()
+	defer func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	}()
+
+	var gotArgs string
+	Register(Command{
+		Trigger: ">",
+		Name:    "echo",
+		Handle: func(ctx context.Context, args string, reply func(string)) {
+			gotArgs = args
+			reply("echo: " + args)
+		},
+	})
+
+	h := New()
+	w := &fakeWriter{}
+	h.Handle(context.Background(), w, &handler.Event{
+		Kind: handler.KindMessage,
+		Nick: "sven",
+		Text: ">echo hello",
+	})
+
+	if gotArgs != "hello" {
+		t.Errorf("Handle args = %q, want %q", gotArgs, "hello")
+	}
+	if len(w.noticed) != 1 || w.noticed[0] != "echo: hello" {
+		t.Errorf("a channel invocation should reply via Notice, got sent=%v noticed=%v", w.sent, w.noticed)
+	}
+
+	w = &fakeWriter{}
+	h.Handle(context.Background(), w, &handler.Event{
+		Kind:    handler.KindMessage,
+		Nick:    "sven",
+		Private: true,
+		Text:    ">echo hi",
+	})
+	if len(w.sent) != 1 || w.sent[0] != "echo: hi" {
+		t.Errorf("a private invocation should reply via Send, got sent=%v noticed=%v", w.sent, w.noticed)
+	}
+}
+
+func TestNew_rateLimits(t *testing.T) {
+	registryMu.Lock()
+	saved := registry
+	registry = nil
+	registryMu.Unlock()
+	defer func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	}()
+
+	calls := 0
+	Register(Command{
+		Trigger: ">",
+		Name:    "ping",
+		Handle: func(ctx context.Context, args string, reply func(string)) {
+			calls++
+		},
+	})
+
+	h := New()
+	w := &fakeWriter{}
+	ev := &handler.Event{Kind: handler.KindMessage, Nick: "flooder", Text: ">ping"}
+	// New's limiter allows a burst of 3; repeated invocations beyond that
+	// within the same instant should be dropped.
+	for i := 0; i < 10; i++ {
+		h.Handle(context.Background(), w, ev)
+	}
+	if calls == 0 || calls >= 10 {
+		t.Errorf("calls = %d, want somewhere between 1 and 9 (rate-limited)", calls)
+	}
+
+	_ = time.Second // rate is tokens/sec; no need to sleep for this assertion
+}
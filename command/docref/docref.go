@@ -0,0 +1,60 @@
+// Package docref registers the doc-file Command: it expands references
+// like ">userguide" or ">multi-monitor#fullscreen" in chat lines into
+// links to the i3 documentation. Unlike most commands it has no fixed
+// Name (the set of valid references changes at runtime, as the doc index
+// is refreshed) and a single line can contain more than one reference, so
+// it uses Command.Scan instead of Trigger/Name.
+package docref
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/stapelberg/go-buildbot-announce/command"
+)
+
+// DocFiles is consulted by Scan to decide whether a >name mention is a
+// valid documentation reference. main() keeps it in sync with the
+// upstream doc index. It's a package var, not a Command field, because
+// the doc index is refreshed in the background after startup and Command
+// has no hook for supplying config to Scan/Handle.
+var DocFiles func() []string
+
+func init() {
+	command.Register(command.Command{
+		Help:   "Expands >docname mentions (e.g. >userguide) into links to the i3 documentation.",
+		Scan:   scan,
+		Handle: handle,
+	})
+}
+
+var docrefRe = regexp.MustCompile(`\s*>([a-zA-Z0-9-]*)(#[a-zA-Z0-9_-]+)?\b`)
+
+// scan returns one args string ("name" or "name#fragment") per >name
+// mention in text that names a file returned by DocFiles.
+func scan(text string) (matches []string) {
+	if DocFiles == nil {
+		return nil
+	}
+	for _, m := range docrefRe.FindAllStringSubmatch(text, -1) {
+		log.Printf("Checking whether *%s* is a valid docref…", strings.ToLower(m[1]))
+		for _, valid := range DocFiles() {
+			if valid == m[1] {
+				matches = append(matches, m[1]+m[2])
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func handle(ctx context.Context, args string, reply func(string)) {
+	name, fragment := args, ""
+	if i := strings.IndexByte(args, '#'); i != -1 {
+		name, fragment = args[:i], args[i:]
+	}
+	reply(fmt.Sprintf("[Documentation reference] http://i3wm.org/docs/%s.html%s", name, fragment))
+}
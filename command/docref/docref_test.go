@@ -0,0 +1,61 @@
+package docref
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func withDocFiles(t *testing.T, files []string) {
+	t.Helper()
+	saved := DocFiles
+	DocFiles = func() []string { return files }
+	t.Cleanup(func() { DocFiles = saved })
+}
+
+func TestScan(t *testing.T) {
+	withDocFiles(t, []string{"userguide", "multi-monitor"})
+
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"check >userguide for details", []string{"userguide"}},
+		{"see >multi-monitor#fullscreen", []string{"multi-monitor#fullscreen"}},
+		{">userguide and >multi-monitor#fullscreen", []string{"userguide", "multi-monitor#fullscreen"}},
+		{"not a >docref-that-exists", nil},
+		{"no references here", nil},
+	}
+	for _, c := range cases {
+		if got := scan(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("scan(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+}
+
+func TestScan_noDocFiles(t *testing.T) {
+	saved := DocFiles
+	DocFiles = nil
+	defer func() { DocFiles = saved }()
+
+	if got := scan(">userguide"); got != nil {
+		t.Errorf("scan() with DocFiles unset = %v, want nil", got)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	cases := []struct {
+		args string
+		want string
+	}{
+		{"userguide", "[Documentation reference] http://i3wm.org/docs/userguide.html"},
+		{"multi-monitor#fullscreen", "[Documentation reference] http://i3wm.org/docs/multi-monitor.html#fullscreen"},
+	}
+	for _, c := range cases {
+		var got string
+		handle(context.Background(), c.args, func(s string) { got = s })
+		if got != c.want {
+			t.Errorf("handle(%q) replied %q, want %q", c.args, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package config parses the bot's configuration file, which declares one or
+// more IRC networks to connect to plus rules for routing incoming HTTP
+// events (buildbot results, pushed commits) to the right network/channel.
+//
+// The file is JSON so that it can be decoded with encoding/json like the
+// rest of this codebase; see i3build.json.example for the expected shape.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Sasl holds the credentials used for SASL PLAIN authentication on a
+// Network. It is omitted (left nil) for networks that don't need it.
+type Sasl struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// Channel is a single channel a bot joins on a Network, with the plugins
+// enabled in it. A nil Plugins means "all registered plugins".
+type Channel struct {
+	Name    string   `json:"name"`
+	Plugins []string `json:"plugins"`
+}
+
+// Route decides which Network/Channel an HTTP-originated event is
+// announced to, based on a regular expression matched against the
+// buildbot buildername (or, for /push_commit, the repository name).
+type Route struct {
+	Match   string `json:"match"`
+	Network string `json:"network"`
+	Channel string `json:"channel"`
+
+	matchRe *regexp.Regexp
+}
+
+// compile parses Match into a usable regular expression. It must be called
+// (Load does this for every route) before MatchString is used.
+func (r *Route) compile() error {
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("route %q: %v", r.Match, err)
+	}
+	r.matchRe = re
+	return nil
+}
+
+// MatchString reports whether s (typically a buildername) matches this
+// route.
+func (r *Route) MatchString(s string) bool {
+	return r.matchRe != nil && r.matchRe.MatchString(s)
+}
+
+// Network is one IRC server the bot maintains a connection to.
+type Network struct {
+	Name     string    `json:"name"`
+	Server   string    `json:"server"`
+	Port     int       `json:"port"`
+	TLS      bool      `json:"tls"`
+	Nick     string    `json:"nick"`
+	Sasl     *Sasl     `json:"sasl"`
+	Channels []Channel `json:"channels"`
+}
+
+// compile validates n. SASL PLAIN sends the password base64-encoded, not
+// encrypted, so requiring tls here means we never send credentials in
+// cleartext regardless of how the config was put together.
+func (n *Network) compile() error {
+	if n.Sasl != nil && !n.TLS {
+		return fmt.Errorf("network %q: sasl requires tls (refusing to send credentials in cleartext)", n.Name)
+	}
+	return nil
+}
+
+// Feed describes one RSS/Atom source the bot should poll and announce new
+// items from. Every is a duration string as accepted by time.ParseDuration
+// (e.g. "30m", "1h").
+type Feed struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Every   string `json:"every"`
+	Channel string `json:"channel"`
+
+	every time.Duration
+}
+
+// Interval returns Every parsed as a time.Duration; compile must have been
+// called first (Load does this for every feed).
+func (f *Feed) Interval() time.Duration {
+	return f.every
+}
+
+func (f *Feed) compile() error {
+	d, err := time.ParseDuration(f.Every)
+	if err != nil {
+		return fmt.Errorf("feed %q: %v", f.Name, err)
+	}
+	f.every = d
+	return nil
+}
+
+// Config is the top-level configuration, as loaded from disk.
+type Config struct {
+	Networks []Network `json:"networks"`
+	Routes   []Route   `json:"routes"`
+	Feeds    []Feed    `json:"feeds"`
+}
+
+// Load reads and parses the config file at path.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg Config
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	for i := range cfg.Networks {
+		if err := cfg.Networks[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.Feeds {
+		if err := cfg.Feeds[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cfg, nil
+}
+
+// Network looks up a network by name.
+func (c *Config) Network(name string) (*Network, bool) {
+	for i := range c.Networks {
+		if c.Networks[i].Name == name {
+			return &c.Networks[i], true
+		}
+	}
+	return nil, false
+}
+
+// Route returns the network/channel that buildername should be announced
+// to, falling back to the first network's first channel if no route
+// matches (so a bot with a single network/channel needs no routes at all).
+func (c *Config) Route(buildername string) (network, channel string) {
+	for _, r := range c.Routes {
+		if r.MatchString(buildername) {
+			return r.Network, r.Channel
+		}
+	}
+	if len(c.Networks) > 0 && len(c.Networks[0].Channels) > 0 {
+		return c.Networks[0].Name, c.Networks[0].Channels[0].Name
+	}
+	return "", ""
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "i3build.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+		"networks": [
+			{"name": "libera", "server": "irc.libera.chat", "port": 6697, "tls": true,
+			 "nick": "i3", "channels": [{"name": "#i3"}]}
+		],
+		"routes": [
+			{"match": "^docs-", "network": "libera", "channel": "#i3-docs"}
+		],
+		"feeds": [
+			{"name": "planet.i3wm.org", "url": "https://planet.i3wm.org/atom.xml", "every": "30m", "channel": "#i3"}
+		]
+	}`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cfg.Network("libera"); !ok {
+		t.Error("Network(\"libera\") not found")
+	}
+	if _, ok := cfg.Network("does-not-exist"); ok {
+		t.Error("Network(\"does-not-exist\") unexpectedly found")
+	}
+
+	if got, want := cfg.Feeds[0].Interval().String(), "30m0s"; got != want {
+		t.Errorf("Feeds[0].Interval() = %s, want %s", got, want)
+	}
+}
+
+func TestLoad_missingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "does-not-exist.json")); err == nil {
+		t.Error("Load of a missing file did not return an error")
+	}
+}
+
+func TestLoad_invalidRoute(t *testing.T) {
+	path := writeConfig(t, `{"routes": [{"match": "(", "network": "n", "channel": "#c"}]}`)
+	if _, err := Load(path); err == nil {
+		t.Error("Load with an invalid route regexp did not return an error")
+	}
+}
+
+func TestLoad_invalidFeedInterval(t *testing.T) {
+	path := writeConfig(t, `{"feeds": [{"name": "f", "url": "http://example.com/feed", "every": "not-a-duration", "channel": "#c"}]}`)
+	if _, err := Load(path); err == nil {
+		t.Error("Load with an invalid feed interval did not return an error")
+	}
+}
+
+func TestLoad_saslWithoutTLSRejected(t *testing.T) {
+	path := writeConfig(t, `{
+		"networks": [
+			{"name": "libera", "server": "irc.libera.chat", "port": 6667, "tls": false,
+			 "nick": "i3", "sasl": {"user": "i3", "pass": "hunter2"}, "channels": [{"name": "#i3"}]}
+		]
+	}`)
+	if _, err := Load(path); err == nil {
+		t.Error("Load with sasl configured but tls: false did not return an error")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	cfg := &Config{
+		Networks: []Network{
+			{Name: "libera", Channels: []Channel{{Name: "#i3"}}},
+		},
+		Routes: []Route{
+			{Match: "^docs-", Network: "libera", Channel: "#i3-docs"},
+		},
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if network, channel := cfg.Route("docs-userguide"); network != "libera" || channel != "#i3-docs" {
+		t.Errorf("Route(%q) = (%q, %q), want (libera, #i3-docs)", "docs-userguide", network, channel)
+	}
+
+	// No route matches: falls back to the first network's first channel.
+	if network, channel := cfg.Route("buildbot-master"); network != "libera" || channel != "#i3" {
+		t.Errorf("Route(%q) = (%q, %q), want (libera, #i3)", "buildbot-master", network, channel)
+	}
+}
@@ -0,0 +1,260 @@
+// Package feeds polls a set of RSS/Atom feeds on a schedule and emits one
+// chat line per new item, e.g. upstream git tags, planet.i3wm.org posts or
+// release notes, without requiring a buildbot webhook for every source.
+package feeds
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Feed describes a single RSS/Atom source to poll.
+type Feed struct {
+	Name    string
+	URL     string
+	Every   time.Duration
+	Channel string
+}
+
+// maxItemsPerTick caps how many items we announce for a single feed on a
+// single poll, so that a feed first added to the config (with potentially
+// years of backlog) doesn't flood the channel.
+const maxItemsPerTick = 5
+
+// Announcement is one new feed item, formatted as a chat line and tagged
+// with the channel it should be sent to.
+type Announcement struct {
+	Channel string
+	Line    string
+}
+
+// Watch polls every feed in feeds on its own ticker and sends one
+// Announcement per new item to out, until ctx is canceled. Already
+// announced items are tracked per feed by publication timestamp and
+// persisted to statePath (as JSON) so a restart doesn't re-announce
+// everything.
+func Watch(ctx context.Context, feeds []Feed, out chan<- Announcement, statePath string) {
+	store := newStateStore(loadState(statePath), statePath)
+
+	for _, f := range feeds {
+		go watchOne(ctx, f, out, store)
+	}
+
+	<-ctx.Done()
+}
+
+func watchOne(ctx context.Context, f Feed, out chan<- Announcement, st *stateStore) {
+	pollOnce(f, out, st)
+
+	ticker := time.NewTicker(f.Every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollOnce(f, out, st)
+		}
+	}
+}
+
+// pollOnce fetches f, announces every item published after st's last-seen
+// timestamp for f.Name (capped at maxItemsPerTick per call), and advances
+// that timestamp — but only past the items it actually announced. Items
+// aren't guaranteed to come back from fetch newest-first, so an item
+// beyond the cap can be newer than one that got announced; advancing past
+// it anyway would skip it for good instead of letting it catch up on a
+// later call.
+func pollOnce(f Feed, out chan<- Announcement, st *stateStore) {
+	items, err := fetch(f.URL)
+	if err != nil {
+		log.Printf("[feeds] %s: %v", f.Name, err)
+		return
+	}
+
+	lastSeen := st.get(f.Name)
+	newest := lastSeen
+	announced := 0
+	for _, it := range items {
+		if !it.published.After(lastSeen) {
+			continue
+		}
+		if announced >= maxItemsPerTick {
+			continue
+		}
+		out <- Announcement{
+			Channel: f.Channel,
+			Line:    fmt.Sprintf("[%s] %s — %s", f.Name, it.title, it.link),
+		}
+		announced++
+		if it.published.After(newest) {
+			newest = it.published
+		}
+	}
+	if announced == maxItemsPerTick {
+		log.Printf("[feeds] %s: capped at %d new items this tick, items newer than those announced will follow on later ticks", f.Name, maxItemsPerTick)
+	}
+	if newest.After(lastSeen) {
+		st.set(f.Name, newest)
+	}
+}
+
+type item struct {
+	title     string
+	link      string
+	published time.Time
+}
+
+// rssOrAtom is a generic container that can decode either an RSS 2.0
+// <channel><item>…</item></channel> feed or an Atom <feed><entry>…
+// </entry></feed> feed.
+type rssOrAtom struct {
+	XMLName xml.Name `xml:"-"`
+	Channel struct {
+		Items []struct {
+			Title   string `xml:"title"`
+			Link    string `xml:"link"`
+			PubDate string `xml:"pubDate"`
+			GUID    string `xml:"guid"`
+		} `xml:"item"`
+	} `xml:"channel"`
+	Entries []struct {
+		Title   string `xml:"title"`
+		Link    struct {
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+		Updated string `xml:"updated"`
+		ID      string `xml:"id"`
+	} `xml:"entry"`
+}
+
+var timeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+}
+
+func parseTime(s string) time.Time {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func fetch(url string) ([]item, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed rssOrAtom
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", url, err)
+	}
+
+	var items []item
+	for _, entry := range parsed.Channel.Items {
+		items = append(items, item{
+			title:     entry.Title,
+			link:      entry.Link,
+			published: parseTime(entry.PubDate),
+		})
+	}
+	for _, entry := range parsed.Entries {
+		items = append(items, item{
+			title:     entry.Title,
+			link:      entry.Link.Href,
+			published: parseTime(entry.Updated),
+		})
+	}
+	return items, nil
+}
+
+// stateStore guards the last-seen-publication-timestamp map and persists
+// it to disk on every update.
+type stateStore struct {
+	path string
+	ch   chan func(map[string]time.Time) map[string]time.Time
+}
+
+func newStateStore(initial map[string]time.Time, path string) *stateStore {
+	st := &stateStore{
+		path: path,
+		ch:   make(chan func(map[string]time.Time) map[string]time.Time),
+	}
+	go st.loop(initial)
+	return st
+}
+
+func (s *stateStore) loop(state map[string]time.Time) {
+	for mutate := range s.ch {
+		state = mutate(state)
+	}
+}
+
+func (s *stateStore) get(feed string) time.Time {
+	result := make(chan time.Time, 1)
+	s.ch <- func(state map[string]time.Time) map[string]time.Time {
+		result <- state[feed]
+		return state
+	}
+	return <-result
+}
+
+func (s *stateStore) set(feed string, t time.Time) {
+	done := make(chan struct{})
+	s.ch <- func(state map[string]time.Time) map[string]time.Time {
+		state[feed] = t
+		saveState(s.path, state)
+		close(done)
+		return state
+	}
+	<-done
+}
+
+func loadState(path string) map[string]time.Time {
+	state := make(map[string]time.Time)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("[feeds] Could not parse state file %s: %v", path, err)
+	}
+	return state
+}
+
+func saveState(path string, state map[string]time.Time) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("[feeds] Could not marshal state: %v", err)
+		return
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("[feeds] Could not write state file %s: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("[feeds] Could not rename state file into place: %v", err)
+	}
+}
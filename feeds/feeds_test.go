@@ -0,0 +1,156 @@
+package feeds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	cases := []struct {
+		name string
+		s    string
+		want time.Time
+	}{
+		{"RFC1123Z", "Mon, 02 Jan 2023 15:04:05 +0000", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"RFC1123", "Mon, 02 Jan 2023 15:04:05 UTC", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"RFC3339", "2023-01-02T15:04:05Z", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"unparsable", "not a date", time.Time{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parseTime(c.s); !got.Equal(c.want) {
+				t.Errorf("parseTime(%q) = %v, want %v", c.s, got, c.want)
+			}
+		})
+	}
+}
+
+const rssBody = `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+<item><title>RSS item</title><link>https://example.com/rss-item</link><pubDate>Mon, 02 Jan 2023 15:04:05 +0000</pubDate><guid>1</guid></item>
+</channel></rss>`
+
+const atomBody = `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<entry><title>Atom entry</title><link href="https://example.com/atom-entry"/><updated>2023-01-02T15:04:05Z</updated><id>1</id></entry>
+</feed>`
+
+func serve(t *testing.T, body string) string {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestFetch_RSS(t *testing.T) {
+	items, err := fetch(serve(t, rssBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("got %d items, want 1", len(items))
+	}
+	it := items[0]
+	if it.title != "RSS item" || it.link != "https://example.com/rss-item" {
+		t.Errorf("item = %+v, want title/link from the RSS <item>", it)
+	}
+	if want := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC); !it.published.Equal(want) {
+		t.Errorf("published = %v, want %v", it.published, want)
+	}
+}
+
+func TestFetch_Atom(t *testing.T) {
+	items, err := fetch(serve(t, atomBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("got %d items, want 1", len(items))
+	}
+	it := items[0]
+	if it.title != "Atom entry" || it.link != "https://example.com/atom-entry" {
+		t.Errorf("item = %+v, want title/link from the Atom <entry>", it)
+	}
+	if want := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC); !it.published.Equal(want) {
+		t.Errorf("published = %v, want %v", it.published, want)
+	}
+}
+
+func TestFetch_httpError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	if _, err := fetch(ts.URL); err == nil {
+		t.Error("fetch() of a 404 did not return an error")
+	}
+}
+
+// TestPollOnce_capDefersRatherThanDrops drives pollOnce against a feed whose
+// items aren't newest-first, with more new items than maxItemsPerTick: the
+// one beyond the cap is newer than the ones actually announced. A naive
+// implementation that advances its "last seen" timestamp over every
+// eligible item (instead of just the ones it announced) would skip that
+// item forever instead of catching up on the next poll.
+func TestPollOnce_capDefersRatherThanDrops(t *testing.T) {
+	var items []string
+	for i := 0; i < maxItemsPerTick; i++ {
+		d := time.Date(2023, 1, i+1, 0, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+		items = append(items, `<item><title>item `+string(rune('0'+i))+`</title><link>https://example.com/`+string(rune('0'+i))+`</link><pubDate>`+d+`</pubDate></item>`)
+	}
+	// The straggler: published after all of the above, but past the cap in
+	// feed order, so it's the last <item> in the document.
+	stragglerDate := time.Date(2023, 1, 20, 0, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+	body := `<?xml version="1.0"?><rss version="2.0"><channel>` +
+		joinStrings(items) +
+		`<item><title>straggler</title><link>https://example.com/straggler</link><pubDate>` + stragglerDate + `</pubDate></item>` +
+		`</channel></rss>`
+
+	url := serve(t, body)
+	st := newStateStore(map[string]time.Time{}, filepath.Join(t.TempDir(), "state.json"))
+	out := make(chan Announcement, maxItemsPerTick+1)
+	f := Feed{Name: "test", URL: url, Channel: "#test"}
+
+	pollOnce(f, out, st)
+	if got := len(out); got != maxItemsPerTick {
+		t.Fatalf("tick 1: got %d announcements, want %d (the cap)", got, maxItemsPerTick)
+	}
+	for i := 0; i < maxItemsPerTick; i++ {
+		<-out
+	}
+
+	pollOnce(f, out, st)
+	select {
+	case a := <-out:
+		if a.Line == "" || !contains(a.Line, "straggler") {
+			t.Errorf("tick 2 announced %q, want the straggler item", a.Line)
+		}
+	default:
+		t.Fatal("tick 2: the straggler item was silently dropped instead of deferred")
+	}
+}
+
+func joinStrings(ss []string) string {
+	out := ""
+	for _, s := range ss {
+		out += s
+	}
+	return out
+}
+
+func contains(s, substr string) bool {
+	return len(s) >= len(substr) && (func() bool {
+		for i := 0; i+len(substr) <= len(s); i++ {
+			if s[i:i+len(substr)] == substr {
+				return true
+			}
+		}
+		return false
+	})()
+}
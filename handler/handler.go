@@ -0,0 +1,131 @@
+// Package handler defines the middleware chain shared by every plugin that
+// reacts to IRC messages or incoming HTTP events (buildbot results, pushed
+// commits, …). It mirrors the net/http middleware idiom: a Handler processes
+// an Event and may hand it on to the next Handler in the chain.
+package handler
+
+import "context"
+
+// Event is the thing a Handler reacts to. Either Text or Buildbot is set,
+// depending on Kind.
+type Event struct {
+	Kind string
+
+	// Channel this event is destined for (IRC channel name, or the empty
+	// string for events that are not yet bound to a specific channel).
+	Channel string
+
+	// Set when Kind == KindMessage: the raw IRC PRIVMSG line. Set when
+	// Kind == KindCommit: the /push_commit request body.
+	Text string
+
+	// Set when Kind == KindBuildbot: a single already-decoded buildbot
+	// event, ready to be turned into a chat line.
+	Buildbot interface {
+		AsChatLine() string
+	}
+
+	// Set when Kind == KindMessage: the nick that sent the message, and
+	// whether it was sent to us directly (a query) rather than in Channel.
+	Nick    string
+	Private bool
+}
+
+const (
+	KindMessage  = "irc.message"  // an incoming PRIVMSG
+	KindBuildbot = "http.buildbot" // a decoded /push_buildbot event
+	KindCommit   = "http.commit"   // a line from /push_commit
+)
+
+// MessageWriter is how a Handler talks back to IRC. It wraps the
+// connection's outgoing channel so plugins don't need to know about the
+// bot's internals.
+type MessageWriter interface {
+	// Send queues line as a PRIVMSG to the event's channel (or the sender,
+	// for a private message).
+	Send(line string)
+
+	// Notice is like Send, but queues line as a NOTICE. Commands use this
+	// for replies triggered from within a channel, which is IRC netiquette
+	// (NOTICEs are never supposed to trigger an auto-reply, avoiding loops
+	// between two bots).
+	Notice(line string)
+}
+
+// Writer adapts plain functions to a MessageWriter. NoticeFunc may be left
+// nil, in which case Notice falls back to SendFunc.
+type Writer struct {
+	SendFunc   func(line string)
+	NoticeFunc func(line string)
+}
+
+func (w Writer) Send(line string) { w.SendFunc(line) }
+
+func (w Writer) Notice(line string) {
+	if w.NoticeFunc != nil {
+		w.NoticeFunc(line)
+		return
+	}
+	w.SendFunc(line)
+}
+
+// Handler processes a single Event. Implementations ignore Events they don't
+// handle; forwarding to another Handler is done by Middleware.
+type Handler interface {
+	Handle(ctx context.Context, w MessageWriter, ev *Event)
+}
+
+// HandlerFunc adapts a plain function to a Handler.
+type HandlerFunc func(ctx context.Context, w MessageWriter, ev *Event)
+
+func (f HandlerFunc) Handle(ctx context.Context, w MessageWriter, ev *Event) {
+	f(ctx, w, ev)
+}
+
+// Middleware wraps a Handler with additional behavior, forwarding to next
+// when it doesn't want to (or is done) handling the Event itself.
+type Middleware func(next Handler) Handler
+
+// Chain builds a single Handler out of h decorated by mw, in the order
+// given: Chain(h, A, B) behaves like A(B(h)), i.e. A runs first.
+func Chain(h Handler, mw ...Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Dispatcher fans an Event out to every Handler it holds, in order. Unlike
+// Middleware, the Handlers in a Dispatcher don't see each other and can't
+// short-circuit one another; each plugin simply gets a look at the Event.
+type Dispatcher []Handler
+
+func (d Dispatcher) Handle(ctx context.Context, w MessageWriter, ev *Event) {
+	for _, h := range d {
+		h.Handle(ctx, w, ev)
+	}
+}
+
+// Factory builds a Handler from plugin-specific configuration. cfg is
+// whatever the plugin needs; it is opaque to the registry and must be
+// type-asserted by the factory.
+type Factory func(cfg interface{}) Handler
+
+var plugins = make(map[string]Factory)
+
+// RegisterPlugin makes a plugin's factory available under name, for Lookup.
+// Registering does not by itself add a plugin to the chain main() builds:
+// main() constructs that chain from a fixed list of plugins and looks up
+// only "command" by name. Plugins usually call this from an init() function.
+func RegisterPlugin(name string, factory Factory) {
+	if _, dup := plugins[name]; dup {
+		panic("handler: RegisterPlugin called twice for " + name)
+	}
+	plugins[name] = factory
+}
+
+// Lookup returns the factory registered under name, if any.
+func Lookup(name string) (Factory, bool) {
+	factory, ok := plugins[name]
+	return factory, ok
+}
@@ -5,32 +5,110 @@
 // © 2011-2012 Michael Stapelberg (see also: LICENSE)
 package main
 
-import irc "github.com/fluffle/goirc/client"
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	// command/atstatus is only imported for its init() side effect (it
+	// registers the ">at" command); command itself is pulled in
+	// transitively and looked up by name below, like any third-party
+	// plugin would be.
+	_ "github.com/stapelberg/go-buildbot-announce/command/atstatus"
+	"github.com/stapelberg/go-buildbot-announce/command/docref"
+	"github.com/stapelberg/go-buildbot-announce/config"
+	"github.com/stapelberg/go-buildbot-announce/feeds"
+	"github.com/stapelberg/go-buildbot-announce/handler"
+	"github.com/stapelberg/go-buildbot-announce/plugin/buildbot"
+	"github.com/stapelberg/go-buildbot-announce/plugin/commitpush"
+	"github.com/stapelberg/go-buildbot-announce/plugin/urltitle"
 )
 
-var to_irc chan string
+var config_path *string = flag.String("config", "i3build.json",
+	"Path to the JSON config file describing the IRC networks, channels "+
+		"and buildbot/commit routing rules this bot should use")
+
+var feeds_state_path *string = flag.String("feeds-state", "i3build-feeds.json",
+	"Path to the file the feed watcher persists last-seen publication "+
+		"timestamps to, so a restart doesn't re-announce old items")
+
+// cfgMu guards cfg, which is replaced wholesale on every SIGHUP reload.
+var cfgMu sync.RWMutex
+var cfg *config.Config
+
+// networks holds one ircNetwork per config.Network, keyed by name, for the
+// lifetime of the process; SIGHUP reloads update them in place instead of
+// replacing them, so existing connections aren't dropped.
+var networks = make(map[string]*ircNetwork)
+
+// chain is built once in main() from the registered plugins and is what
+// every incoming event (IRC message, buildbot result, pushed commit) is
+// run through, regardless of which network it came from.
+var chain handler.Handler
+
+func currentConfig() *config.Config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg
+}
 
-var irc_channel *string = flag.String("channel", "#i3",
-	"In which channel this bot should be in")
+// pluginEnabled reports whether plugin should run for channel, based on
+// that channel's Plugins list in the current config. A channel with no
+// Plugins list (or one not found at all, e.g. an HTTP event not yet bound
+// to a channel) has every plugin enabled.
+func pluginEnabled(channel, plugin string) bool {
+	c := currentConfig()
+	if c == nil || channel == "" {
+		return true
+	}
+	for _, net := range c.Networks {
+		for _, ch := range net.Channels {
+			if ch.Name != channel {
+				continue
+			}
+			if ch.Plugins == nil {
+				return true
+			}
+			for _, p := range ch.Plugins {
+				if p == plugin {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
 
-// This is naive, but hopefully good enough :)
-var url_re *regexp.Regexp = regexp.MustCompile("(http://(?:[^ ]*))")
+// gatedBy returns a Middleware that skips next for any channel that
+// disabled the plugin named name via the config's per-channel Plugins
+// list. It's applied to each plugin individually with handler.Chain, e.g.
+// handler.Chain(urltitle.New(), gatedBy("urltitle")).
+func gatedBy(name string) handler.Middleware {
+	return func(next handler.Handler) handler.Handler {
+		return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+			if !pluginEnabled(ev.Channel, name) {
+				return
+			}
+			next.Handle(ctx, w, ev)
+		})
+	}
+}
 
 // Another simple HTML parsing regular expression, but since we control the
 // output (served by cgit), that’s not a big problem :).
 var doclink_re *regexp.Regexp = regexp.MustCompile(`href='[^']*'>([^<]*)\.html`)
-var docref_re *regexp.Regexp = regexp.MustCompile(`\s*>([a-zA-Z0-9-]*)(#[a-zA-Z0-9_-]+)?\b`)
 
 // List of documentation filenames, without the trailing .html, so for example
 // "userguide", "multi-monitor", etc.
@@ -120,92 +198,6 @@ func (o *BuildbotEvent) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func getURLTitle(url string) {
-	result := make(chan *http.Response, 1)
-	go func() {
-		resp, err := http.Get(url)
-		if err != nil {
-			result <- nil
-			return
-		}
-		result <- resp
-	}()
-
-	go func() {
-		time.Sleep(10 * time.Second)
-		result <- nil
-	}()
-
-	resp := <-result
-	if resp == nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	fmt.Printf(`URL "%s", status %d\n`, url, resp.StatusCode)
-
-	// Check for the special case of a , or ) being the last character of the
-	// URL. This happens when the URL is used without leaving a whitespace
-	// between the text, for example in "hey, i followed the userguide
-	// (http://i3wm.org/docs/userguide.html) and it doesn’t work". We can’t
-	// always split on these characters since some pages (like spiegel.de) use
-	// strange characters in their normal URLs.
-	if resp.StatusCode == 404 &&
-		(strings.HasSuffix(url, ",") || strings.HasSuffix(url, ")")) {
-		getURLTitle(strings.TrimRight(url, ",)"))
-		return
-	}
-
-	if resp.StatusCode != 200 {
-		return
-	}
-
-	reader := bufio.NewReaderSize(resp.Body, 1*1024*1024)
-	for {
-		line, _, readerr := reader.ReadLine()
-		if readerr != nil {
-			fmt.Printf("read error (HTTP response for %s): %s\n", url, readerr.Error())
-			return
-		}
-		titleRegexp := regexp.MustCompile("<title>(.*)</title>")
-		matches := titleRegexp.FindSubmatch(line)
-		if len(matches) > 1 {
-			to_irc <- fmt.Sprintf("[Link info] %s", string(matches[1]))
-			return
-		}
-
-		if readerr != nil {
-			log.Printf("Error reading HTTP response for %s: %s\n", url, readerr.Error())
-			return
-		}
-	}
-}
-
-func handleLine(conn *irc.Conn, line *irc.Line) {
-	msg := line.Args[1]
-	if line.Args[0] != *irc_channel {
-		log.Printf(`Ignoring private message to me: "%s"`, msg)
-		return
-	}
-
-	// We have a few trigger words which aim to make support easier:
-	docmatches := docref_re.FindAllStringSubmatch(msg, -1)
-	for _, match := range docmatches {
-		docref := strings.ToLower(match[1])
-		log.Printf("Checking whether *%s* is a valid docref…", docref)
-		for _, valid_doc := range docfiles {
-			if valid_doc == match[1] {
-				if len(match) > 2 {
-					to_irc <- fmt.Sprintf("[Documentation reference] http://i3wm.org/docs/%s.html%s", match[1], match[2])
-				} else {
-					to_irc <- fmt.Sprintf("[Documentation reference] http://i3wm.org/docs/%s.html", match[1])
-				}
-				break
-			}
-		}
-	}
-}
-
 // Gets the directory index of
 // http://code.stapelberg.de/git/i3-website/tree/docs and stores all .html
 // files in a list so that we can recognize them in IRC messages.
@@ -233,14 +225,128 @@ func getDocFilenames() {
 	log.Printf("docfiles = %s", docfiles)
 }
 
+// routeTarget decides which network/channel an HTTP-originated event goes
+// to: an explicit network=/channel= query parameter wins, otherwise the
+// buildername (or, for /push_commit, the repository name passed the same
+// way) is matched against the configured routing rules.
+func routeTarget(r *http.Request, buildername string) (network, channel string) {
+	if n, ch := r.URL.Query().Get("network"), r.URL.Query().Get("channel"); n != "" && ch != "" {
+		return n, ch
+	}
+	return currentConfig().Route(buildername)
+}
+
+// networkForChannel returns the network whose config lists channel among
+// its Channels, used to resolve plain channel names (as given in a Feed's
+// Channel field) to the connection they should be announced on.
+func networkForChannel(channel string) (*ircNetwork, bool) {
+	c := currentConfig()
+	for _, net := range c.Networks {
+		for _, ch := range net.Channels {
+			if ch.Name == channel {
+				n, ok := networks[net.Name]
+				return n, ok
+			}
+		}
+	}
+	return nil, false
+}
+
+// reload re-parses the config file and diff-applies the channel list of
+// every network that is already running, joining and parting channels
+// without dropping the connection. Networks added to the config after the
+// initial startup are not started, and networks removed from it stay
+// connected.
+func reload() {
+	log.Printf("Reloading config from %s\n", *config_path)
+	newCfg, err := config.Load(*config_path)
+	if err != nil {
+		log.Printf("Could not reload config: %s\n", err.Error())
+		return
+	}
+
+	cfgMu.Lock()
+	cfg = newCfg
+	cfgMu.Unlock()
+
+	for _, netCfg := range newCfg.Networks {
+		if n, ok := networks[netCfg.Name]; ok {
+			n.ApplyChannels(netCfg.Channels)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
+	loaded, err := config.Load(*config_path)
+	if err != nil {
+		log.Fatalf("Could not load config %s: %s\n", *config_path, err.Error())
+	}
+	cfg = loaded
+
 	go getDocFilenames()
 
-	// Channel on which the HTTP handler sends lines to IRC.
-	to_irc = make(chan string)
-	quit := make(chan bool)
+	// docref's Scan-based Command reads the doc index through this package
+	// var (see command/docref's doc comment for why: Command has no hook
+	// for passing it config).
+	docref.DocFiles = func() []string { return docfiles }
+
+	// Build the chain every event (IRC message or pushed HTTP event) is run
+	// through. Each plugin only acts on the Event kinds it cares about and
+	// ignores the rest, so they can all live in the same flat Dispatcher;
+	// each one is individually wrapped with handler.Chain + gatedBy so a
+	// channel can disable it via its Plugins toggle list. The "command"
+	// plugin (registered by command/builtin.go's init(), like any
+	// third-party plugin would) ships ">help"/">source"/">at"/docref.
+	commandFactory, _ := handler.Lookup("command")
+	chain = handler.Chain(handler.Dispatcher{
+		handler.Chain(urltitle.New(), gatedBy("urltitle")),
+		handler.Chain(buildbot.New(), gatedBy("buildbot")),
+		handler.Chain(commitpush.New(), gatedBy("commitpush")),
+		handler.Chain(commandFactory(nil), gatedBy("command")),
+	})
+
+	for _, netCfg := range cfg.Networks {
+		n := newIRCNetwork(netCfg)
+		networks[netCfg.Name] = n
+		go n.run(context.Background(), chain)
+	}
+
+	// Feeds are announced straight to their configured channel; they don't
+	// go through the plugin chain since they aren't triggered by an IRC
+	// message or buildbot/commit event. All feeds share one Watch call (and
+	// one state file) so last-seen timestamps for different feeds don't
+	// clobber each other on disk.
+	if len(cfg.Feeds) > 0 {
+		var watched []feeds.Feed
+		for _, f := range cfg.Feeds {
+			if _, ok := networkForChannel(f.Channel); !ok {
+				log.Printf("[feeds] %s: channel %q is not on any configured network, skipping\n", f.Name, f.Channel)
+				continue
+			}
+			watched = append(watched, feeds.Feed{
+				Name:    f.Name,
+				URL:     f.URL,
+				Every:   f.Interval(),
+				Channel: f.Channel,
+			})
+		}
+
+		announcements := make(chan feeds.Announcement)
+		go feeds.Watch(context.Background(), watched, announcements, *feeds_state_path)
+
+		go func() {
+			for a := range announcements {
+				n, ok := networkForChannel(a.Channel)
+				if !ok {
+					log.Printf("[feeds] Dropping announcement for removed channel %q\n", a.Channel)
+					continue
+				}
+				n.writer(a.Channel).Send(a.Line)
+			}
+		}()
+	}
 
 	http.HandleFunc("/push_buildbot",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -249,17 +355,34 @@ func main() {
 				log.Printf("Could not ParseForm: %s", err.Error())
 			}
 
-			// Decode the JSON into BuildbotEvents and send them to IRC if
-			// appropriate.
+			// Decode the JSON into BuildbotEvents and run them through the
+			// chain, which announces them to IRC.
 			var packets []BuildbotEvent
 			err := json.Unmarshal([]byte(r.Form.Get("packets")), &packets)
 			if err != nil {
 				log.Printf("Could not parse JSON: %s\n", err.Error())
 			}
 			for _, event := range packets {
-				if event.Ev != nil {
-					to_irc <- event.Ev.AsChatLine()
+				if event.Ev == nil {
+					continue
+				}
+				globalMetrics.IncEventsReceived()
+				fin, _ := event.Ev.(*BuildFinishedEvent)
+				buildername := ""
+				if fin != nil {
+					buildername = fin.buildername
+				}
+				netName, channel := routeTarget(r, buildername)
+				n, ok := networks[netName]
+				if !ok {
+					log.Printf("Dropping buildbot event: unknown network %q\n", netName)
+					continue
 				}
+				chain.Handle(r.Context(), n.writer(channel), &handler.Event{
+					Kind:     handler.KindBuildbot,
+					Channel:  channel,
+					Buildbot: event.Ev,
+				})
 			}
 		})
 
@@ -270,12 +393,44 @@ func main() {
 				log.Printf("Could not read body: %s\n", err.Error())
 				return
 			}
-			lines := strings.Split(string(body), "\n")
-			for _, line := range lines {
-				to_irc <- line
+			netName, channel := routeTarget(r, r.URL.Query().Get("repo"))
+			n, ok := networks[netName]
+			if !ok {
+				log.Printf("Dropping commit push: unknown network %q\n", netName)
+				return
 			}
+			globalMetrics.IncEventsReceived()
+			chain.Handle(r.Context(), n.writer(channel), &handler.Event{
+				Kind:    handler.KindCommit,
+				Channel: channel,
+				Text:    string(body),
+			})
 		})
 
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	})
+
+	// /readyz reports success only once every configured network is
+	// connected, so a load balancer or orchestrator can hold off routing
+	// traffic (or restart us) while we're still reconnecting.
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		for name, n := range networks {
+			if st := n.Status(); !st.Connected {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintf(w, "%s: not connected (%s)\n", name, st.LastError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	})
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		globalMetrics.WriteTo(w)
+	})
+
 	// Handle HTTP requests in a different Goroutine.
 	go func() {
 		if err := http.ListenAndServe("localhost:8080", nil); err != nil {
@@ -283,45 +438,16 @@ func main() {
 		}
 	}()
 
-	c := irc.SimpleClient("i3", "i3", "http://build.i3wm.org/")
-
-	c.AddHandler("connected",
-		func(conn *irc.Conn, line *irc.Line) {
-			log.Printf("Connected, joining channel %s\n", *irc_channel)
-			conn.Join(*irc_channel)
-		})
-
-	c.AddHandler("disconnected",
-		func(conn *irc.Conn, line *irc.Line) { quit <- true })
-
-	c.AddHandler("PRIVMSG", handleLine)
-
-	log.Printf("Connecting...\n")
-	if err := c.Connect("irc.twice-irc.de"); err != nil {
-		log.Printf("Connection error: %s\n", err.Error())
-	}
-
-	everyDay := make(chan bool)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		for {
-			time.Sleep(24 * time.Hour)
-			everyDay <- true
+		for range hup {
+			reload()
 		}
 	}()
 
-	// program main loop
 	for {
-		select {
-		case line, _ := <-to_irc:
-			c.Privmsg(*irc_channel, line)
-		case <-everyDay:
-			go getDocFilenames()
-		case <-quit:
-			log.Println("Disconnected. Reconnecting...")
-			if err := c.Connect("irc.twice-irc.de"); err != nil {
-				log.Printf("Connection error: %s\n", err.Error())
-			}
-		}
+		time.Sleep(24 * time.Hour)
+		go getDocFilenames()
 	}
-	log.Fatalln("Fell out of the main loop?!")
 }
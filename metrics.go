@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics holds process-wide counters exposed by the /metrics HTTP handler,
+// in the Prometheus text exposition format. All fields are updated with the
+// sync/atomic package since they're written from every network's goroutine
+// as well as the HTTP handler goroutines.
+type Metrics struct {
+	eventsReceived uint64
+	messagesSent   uint64
+	reconnects     uint64
+	bufferDrops    uint64
+}
+
+// globalMetrics is incremented by network.go and the /push_buildbot and
+// /push_commit handlers in i3build.go, and read by the /metrics handler.
+var globalMetrics Metrics
+
+func (m *Metrics) IncEventsReceived() { atomic.AddUint64(&m.eventsReceived, 1) }
+func (m *Metrics) IncMessagesSent()   { atomic.AddUint64(&m.messagesSent, 1) }
+func (m *Metrics) IncReconnects()     { atomic.AddUint64(&m.reconnects, 1) }
+func (m *Metrics) IncBufferDrops()    { atomic.AddUint64(&m.bufferDrops, 1) }
+
+// WriteTo writes m to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	written, err := fmt.Fprintf(w,
+		"# HELP i3build_events_received_total Events handled (IRC messages, buildbot results, pushed commits).\n"+
+			"# TYPE i3build_events_received_total counter\n"+
+			"i3build_events_received_total %d\n"+
+			"# HELP i3build_messages_sent_total IRC PRIVMSG/NOTICE lines sent.\n"+
+			"# TYPE i3build_messages_sent_total counter\n"+
+			"i3build_messages_sent_total %d\n"+
+			"# HELP i3build_reconnects_total IRC reconnect attempts, across all networks.\n"+
+			"# TYPE i3build_reconnects_total counter\n"+
+			"i3build_reconnects_total %d\n"+
+			"# HELP i3build_buffer_drops_total Outgoing messages dropped because a network's ring buffer was full while disconnected.\n"+
+			"# TYPE i3build_buffer_drops_total counter\n"+
+			"i3build_buffer_drops_total %d\n",
+		atomic.LoadUint64(&m.eventsReceived),
+		atomic.LoadUint64(&m.messagesSent),
+		atomic.LoadUint64(&m.reconnects),
+		atomic.LoadUint64(&m.bufferDrops))
+	return int64(written), err
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+
+	"github.com/stapelberg/go-buildbot-announce/config"
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+// alwaysRequestedCaps are the IRCv3 capabilities every network asks the
+// server for, regardless of configuration. server-time lets us attach a
+// reliable timestamp to events we log. sasl is requested separately (see
+// handleCap) only for networks with credentials configured: the server
+// ACKs or NAKs a single CAP REQ atomically, so bundling it with
+// server-time would mean a server that doesn't support one of the two
+// rejects both, silently leaving SASL-configured networks unauthenticated.
+var alwaysRequestedCaps = []string{"server-time"}
+
+// fatalNumerics are IRC numeric replies that mean retrying the connection
+// with the same configuration would just fail again the same way (the
+// server rejected our password, we're banned from a channel, or a channel
+// needs a key we don't have): 464 ERR_PASSWDMISMATCH, 474
+// ERR_BANNEDFROMCHAN, 475 ERR_BADCHANNELKEY. 904
+// ERR_SASLFAIL belongs here too, but is wired up separately in connect
+// since, unlike these, it also needs a CAP END to unblock registration.
+var fatalNumerics = []string{"464", "474", "475"}
+
+const (
+	// initialBackoff and maxBackoff bound run's reconnect delay: 1s, 2s,
+	// 4s, … capped at 5 minutes.
+	initialBackoff = 1 * time.Second
+	maxBackoff     = 5 * time.Minute
+
+	// maxBufferedEvents bounds how many outgoing chat lines we keep around
+	// per network while disconnected, before dropping the oldest.
+	maxBufferedEvents = 256
+)
+
+// fatalAuthError marks a connection attempt as unrecoverable.
+type fatalAuthError struct {
+	numeric string
+	args    []string
+}
+
+func (e fatalAuthError) Error() string {
+	return fmt.Sprintf("fatal error %s: %s", e.numeric, strings.Join(e.args, " "))
+}
+
+// outgoing is a chat line destined for a specific channel (or nick, for a
+// reply to a private message) on a network.
+type outgoing struct {
+	target string
+	text   string
+	notice bool
+}
+
+// ringBuffer holds outgoing chat lines while a network is disconnected, so
+// that Send/Notice never block (and HTTP handlers or IRC event handlers
+// calling them never deadlock on a down connection). Once it's full, the
+// oldest buffered line is dropped to make room for the newest.
+type ringBuffer struct {
+	mu    sync.Mutex
+	items []outgoing
+	max   int
+}
+
+func newRingBuffer(max int) *ringBuffer {
+	return &ringBuffer{max: max}
+}
+
+// Push appends msg, dropping the oldest buffered message (and counting it
+// in globalMetrics) if the buffer is already full.
+func (r *ringBuffer) Push(msg outgoing) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.items) >= r.max {
+		r.items = r.items[1:]
+		globalMetrics.IncBufferDrops()
+		log.Printf("ringBuffer: dropped oldest buffered message, buffer full (max %d)", r.max)
+	}
+	r.items = append(r.items, msg)
+}
+
+// Drain removes and returns every buffered message.
+func (r *ringBuffer) Drain() []outgoing {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := r.items
+	r.items = nil
+	return items
+}
+
+// Status summarizes an ircNetwork's current connection state, for the
+// /readyz HTTP handler.
+type Status struct {
+	Connected bool
+	LastError string
+}
+
+// ircNetwork owns one IRC connection (as described by a config.Network
+// entry) for its entire lifetime: connecting, CAP/SASL negotiation,
+// joining channels and reconnecting (with exponential backoff) when
+// disconnected.
+type ircNetwork struct {
+	cfg  config.Network
+	buf  *ringBuffer
+	wake chan struct{}
+
+	mu             sync.Mutex
+	negotiatedCaps map[string]bool
+	conn           *irc.Conn // set while connected, consulted by ApplyChannels
+	lastErr        string
+	capLS          strings.Builder // accumulates multiline "CAP * LS *" fragments
+	capReqPending  int             // outstanding CAP REQ lines awaiting ACK/NAK
+}
+
+// newIRCNetwork creates the runtime state for cfg. Call run to actually
+// connect.
+func newIRCNetwork(cfg config.Network) *ircNetwork {
+	return &ircNetwork{
+		cfg:  cfg,
+		buf:  newRingBuffer(maxBufferedEvents),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Status returns a snapshot of n's current connection state.
+func (n *ircNetwork) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{Connected: n.conn != nil, LastError: n.lastErr}
+}
+
+func (n *ircNetwork) setLastErr(s string) {
+	n.mu.Lock()
+	n.lastErr = s
+	n.mu.Unlock()
+}
+
+// writer returns a MessageWriter that sends replies to target (a channel
+// name, or a nick for a private-message reply) on this network.
+func (n *ircNetwork) writer(target string) handler.MessageWriter {
+	return handler.Writer{
+		SendFunc: func(text string) {
+			n.enqueue(outgoing{target: target, text: text})
+		},
+		NoticeFunc: func(text string) {
+			n.enqueue(outgoing{target: target, text: text, notice: true})
+		},
+	}
+}
+
+// enqueue buffers msg for delivery and wakes the send loop in connect if
+// it's waiting. It never blocks, even while disconnected.
+func (n *ircNetwork) enqueue(msg outgoing) {
+	n.buf.Push(msg)
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// client builds a freshly configured irc.Conn for this network; a new one
+// is needed every time we (re-)connect.
+func (n *ircNetwork) client() *irc.Conn {
+	ircCfg := irc.NewConfig(n.cfg.Nick)
+	ircCfg.Server = fmt.Sprintf("%s:%d", n.cfg.Server, n.cfg.Port)
+	ircCfg.Version = "https://github.com/stapelberg/go-buildbot-announce"
+	if n.cfg.TLS {
+		ircCfg.SSL = true
+		ircCfg.SSLConfig = &tls.Config{ServerName: n.cfg.Server}
+	}
+	return irc.Client(ircCfg)
+}
+
+// connect dials the network, running the CAP/SASL dance and joining every
+// configured channel, and returns once disconnected: connected reports
+// whether registration completed at all (used by run to decide whether to
+// reset the backoff), and fatal reports whether the failure was one we
+// shouldn't retry (see fatalNumerics).
+func (n *ircNetwork) connect(chain handler.Handler) (connected, fatal bool, err error) {
+	n.mu.Lock()
+	n.negotiatedCaps = make(map[string]bool)
+	n.capLS.Reset()
+	n.capReqPending = 0
+	n.mu.Unlock()
+
+	quit := make(chan error, 1)
+	var once sync.Once
+	signalQuit := func(e error) {
+		once.Do(func() {
+			quit <- e
+		})
+	}
+
+	c := n.client()
+
+	// REGISTER fires once the TCP connection is up, before NICK/USER are
+	// sent, which is where goirc wants capability negotiation kicked off
+	// (its own doc comment on Conn.Connect reserves CONNECTED for "initial
+	// client work" once registration has completed instead).
+	c.HandleFunc(irc.REGISTER, func(conn *irc.Conn, line *irc.Line) {
+		conn.Raw("CAP LS 302")
+	})
+	// A NAK of "sasl" is fatal like 904 below: this network has credentials
+	// configured, so connecting without authenticating would be wrong, and
+	// retrying would just get NAK'd the same way again.
+	c.HandleFunc("CAP", func(conn *irc.Conn, line *irc.Line) {
+		if fatalErr := n.handleCap(conn, line); fatalErr != nil {
+			n.setLastErr(fatalErr.Error())
+			signalQuit(fatalErr)
+		}
+	})
+	c.HandleFunc("AUTHENTICATE", n.handleAuthenticate)
+	c.HandleFunc("903", n.handleSaslResult)
+	// 904 (ERR_SASLFAIL) is fatal, like the numerics in fatalNumerics:
+	// retrying with the same (wrong) credentials would just fail the same
+	// way forever. Unlike those, we still need to send CAP END ourselves
+	// (via handleSaslResult) so the server doesn't hang waiting for us to
+	// finish negotiation before the connection is torn down.
+	c.HandleFunc("904", func(conn *irc.Conn, line *irc.Line) {
+		n.handleSaslResult(conn, line)
+		n.setLastErr(fmt.Sprintf("904 %s", strings.Join(line.Args, " ")))
+		signalQuit(fatalAuthError{numeric: "904", args: line.Args})
+	})
+
+	for _, numeric := range fatalNumerics {
+		numeric := numeric
+		c.HandleFunc(numeric, func(conn *irc.Conn, line *irc.Line) {
+			n.setLastErr(fmt.Sprintf("%s %s", numeric, strings.Join(line.Args, " ")))
+			signalQuit(fatalAuthError{numeric: numeric, args: line.Args})
+		})
+	}
+
+	c.HandleFunc(irc.CONNECTED, func(conn *irc.Conn, line *irc.Line) {
+		n.mu.Lock()
+		n.conn = conn
+		n.lastErr = ""
+		n.mu.Unlock()
+		connected = true
+		for _, ch := range n.cfg.Channels {
+			log.Printf("[%s] Connected, joining channel %s\n", n.cfg.Name, ch.Name)
+			conn.Join(ch.Name)
+		}
+	})
+
+	c.HandleFunc(irc.DISCONNECTED, func(conn *irc.Conn, line *irc.Line) {
+		n.mu.Lock()
+		n.conn = nil
+		n.mu.Unlock()
+		signalQuit(nil)
+	})
+
+	c.HandleFunc("PRIVMSG", func(conn *irc.Conn, line *irc.Line) {
+		n.handleLine(chain, line)
+	})
+
+	if err := c.Connect(); err != nil {
+		return false, false, err
+	}
+
+	for {
+		select {
+		case <-n.wake:
+			for _, msg := range n.buf.Drain() {
+				if msg.notice {
+					c.Notice(msg.target, msg.text)
+				} else {
+					c.Privmsg(msg.target, msg.text)
+				}
+				globalMetrics.IncMessagesSent()
+			}
+
+		case err := <-quit:
+			if fatalErr, ok := err.(fatalAuthError); ok {
+				return connected, true, fatalErr
+			}
+			return connected, false, err
+		}
+	}
+}
+
+// run connects to the network, reconnecting with exponential backoff and
+// jitter (capped at maxBackoff) until ctx is canceled or a fatal error
+// (see fatalNumerics) gives up for good.
+func (n *ircNetwork) run(ctx context.Context, chain handler.Handler) {
+	backoff := initialBackoff
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if attempt > 0 {
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+			log.Printf("[%s] Reconnecting in %s (attempt %d)...\n", n.cfg.Name, wait, attempt)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			globalMetrics.IncReconnects()
+		}
+
+		log.Printf("[%s] Connecting...\n", n.cfg.Name)
+		connected, fatal, err := n.connect(chain)
+		if err != nil {
+			n.setLastErr(err.Error())
+			log.Printf("[%s] Connection error: %s\n", n.cfg.Name, err)
+		} else {
+			log.Printf("[%s] Disconnected.\n", n.cfg.Name)
+		}
+
+		if fatal {
+			log.Printf("[%s] Giving up after fatal error: %s\n", n.cfg.Name, err)
+			return
+		}
+
+		if connected {
+			backoff = initialBackoff
+		} else {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// ApplyChannels diffs channels against the currently joined ones and parts
+// channels that disappeared and joins ones that were added, without
+// touching the connection itself. It is a no-op (besides updating n.cfg)
+// while disconnected; the next "connected" handler will join the full set.
+func (n *ircNetwork) ApplyChannels(channels []config.Channel) {
+	n.mu.Lock()
+	old := n.cfg.Channels
+	conn := n.conn
+	n.cfg.Channels = channels
+	n.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	oldNames := make(map[string]bool, len(old))
+	for _, ch := range old {
+		oldNames[ch.Name] = true
+	}
+	newNames := make(map[string]bool, len(channels))
+	for _, ch := range channels {
+		newNames[ch.Name] = true
+	}
+
+	for name := range oldNames {
+		if !newNames[name] {
+			log.Printf("[%s] Parting channel %s (removed from config)\n", n.cfg.Name, name)
+			conn.Part(name)
+		}
+	}
+	for name := range newNames {
+		if !oldNames[name] {
+			log.Printf("[%s] Joining channel %s (added to config)\n", n.cfg.Name, name)
+			conn.Join(name)
+		}
+	}
+}
+
+// handleCap drives the IRCv3 capability negotiation. We request our desired
+// caps right after CAP LS, ACK whatever the server grants us and start the
+// SASL PLAIN exchange once "sasl" is granted; otherwise we end negotiation
+// once every outstanding request has been answered, so registration can
+// proceed. It returns a non-nil error only when the server NAKs "sasl" for
+// a network that has credentials configured: retrying with the same
+// configuration would just be NAK'd again, so the caller treats that like
+// a fatal numeric (connect must not silently fall back to unauthenticated).
+func (n *ircNetwork) handleCap(conn *irc.Conn, line *irc.Line) error {
+	if len(line.Args) < 2 {
+		return nil
+	}
+
+	switch line.Args[1] {
+	case "LS":
+		if len(line.Args) < 3 {
+			return nil
+		}
+		// A server (Libera/OFTC routinely do this) may split its CAP LS
+		// reply across several lines: "CAP * LS * :fragment" for every
+		// line but the last, "CAP * LS :fragment" for the last one. We
+		// must buffer every fragment and only request our caps once the
+		// final line arrives, or we'd send CAP REQ (and, if granted,
+		// re-enter the SASL exchange) once per fragment.
+		more := len(line.Args) == 4 && line.Args[2] == "*"
+		caps := line.Args[len(line.Args)-1]
+
+		n.mu.Lock()
+		n.capLS.WriteString(caps)
+		n.mu.Unlock()
+
+		if more {
+			return nil
+		}
+		n.mu.Lock()
+		advertised := n.capLS.String()
+		n.mu.Unlock()
+		log.Printf("[%s] Server advertised capabilities: %s\n", n.cfg.Name, advertised)
+
+		// sasl is requested as its own CAP REQ, separate from
+		// alwaysRequestedCaps: the server ACKs or NAKs a single CAP REQ
+		// atomically, so bundling it with server-time would mean a server
+		// that only supports one of the two rejects both.
+		wantSasl := n.cfg.Sasl != nil
+		n.mu.Lock()
+		n.capReqPending = 1
+		if wantSasl {
+			n.capReqPending++
+		}
+		n.mu.Unlock()
+
+		conn.Raw("CAP REQ :" + strings.Join(alwaysRequestedCaps, " "))
+		if wantSasl {
+			conn.Raw("CAP REQ :sasl")
+		}
+
+	case "ACK":
+		if len(line.Args) < 3 {
+			return nil
+		}
+		n.mu.Lock()
+		for _, cap := range strings.Fields(line.Args[2]) {
+			n.negotiatedCaps[cap] = true
+		}
+		n.capReqPending--
+		pending := n.capReqPending
+		gotSasl := n.negotiatedCaps["sasl"]
+		n.mu.Unlock()
+
+		if gotSasl && n.cfg.Sasl != nil {
+			// CAP END happens once handleSaslResult sees 903/904, not here.
+			conn.Raw("AUTHENTICATE PLAIN")
+			return nil
+		}
+		if pending == 0 {
+			conn.Raw("CAP END")
+		}
+
+	case "NAK":
+		rejected := line.Args[2]
+		log.Printf("[%s] Server rejected capabilities: %s\n", n.cfg.Name, rejected)
+		n.mu.Lock()
+		n.capReqPending--
+		pending := n.capReqPending
+		n.mu.Unlock()
+
+		if n.cfg.Sasl != nil && capListHas(rejected, "sasl") {
+			return fatalAuthError{numeric: "CAP NAK", args: []string{"sasl"}}
+		}
+		if pending == 0 {
+			conn.Raw("CAP END")
+		}
+	}
+	return nil
+}
+
+// capListHas reports whether cap appears in a space-separated capability
+// list, e.g. the trailing argument of a CAP ACK/NAK line.
+func capListHas(list, cap string) bool {
+	for _, c := range strings.Fields(list) {
+		if c == cap {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAuthenticate replies to the server's "AUTHENTICATE +" continuation
+// with the base64-encoded SASL PLAIN payload: \0user\0pass.
+func (n *ircNetwork) handleAuthenticate(conn *irc.Conn, line *irc.Line) {
+	if len(line.Args) == 0 || line.Args[0] != "+" || n.cfg.Sasl == nil {
+		return
+	}
+	payload := fmt.Sprintf("\x00%s\x00%s", n.cfg.Sasl.User, n.cfg.Sasl.Pass)
+	conn.Raw("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(payload)))
+}
+
+// handleSaslResult is registered for both 903 (RPL_SASLSUCCESS) and 904
+// (ERR_SASLFAIL). Either way, CAP negotiation is done once we get here.
+func (n *ircNetwork) handleSaslResult(conn *irc.Conn, line *irc.Line) {
+	if line.Cmd == "904" {
+		log.Printf("[%s] SASL authentication failed: %s\n", n.cfg.Name, line.Args)
+	} else {
+		log.Printf("[%s] SASL authentication succeeded\n", n.cfg.Name)
+	}
+	conn.Raw("CAP END")
+}
+
+// messageTime returns the server-time tag attached to line, if the
+// server-time capability was negotiated and the server sent one, or the
+// current local time otherwise.
+func (n *ircNetwork) messageTime(line *irc.Line) time.Time {
+	n.mu.Lock()
+	haveServerTime := n.negotiatedCaps["server-time"]
+	n.mu.Unlock()
+	if haveServerTime {
+		if raw, ok := line.Tags["time"]; ok {
+			if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Now()
+}
+
+// handleLine turns an incoming PRIVMSG into a handler.Event and runs it
+// through chain. The actual behavior (URL titles, >docref expansion, …)
+// lives in the plugins chain was built from.
+func (n *ircNetwork) handleLine(chain handler.Handler, line *irc.Line) {
+	msg := line.Args[1]
+	channel := line.Args[0]
+	// A PRIVMSG sent directly to us (rather than to a channel we're in)
+	// has our own nick as its target.
+	private := channel == n.cfg.Nick
+	log.Printf("[%s] [%s] %s", n.cfg.Name, n.messageTime(line).Format(time.RFC3339), msg)
+
+	replyTarget := channel
+	if private {
+		replyTarget = line.Nick
+	}
+
+	globalMetrics.IncEventsReceived()
+	chain.Handle(context.Background(), n.writer(replyTarget), &handler.Event{
+		Kind:    handler.KindMessage,
+		Channel: channel,
+		Nick:    line.Nick,
+		Private: private,
+		Text:    msg,
+	})
+}
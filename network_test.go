@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/go-buildbot-announce/config"
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+// fakeServer accepts a single connection and hands back a *bufio.Reader for
+// reading what the client sent, plus the raw net.Conn for writing replies.
+type fakeServer struct {
+	ln   net.Listener
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeServer{ln: ln}
+}
+
+func (s *fakeServer) accept(t *testing.T) {
+	t.Helper()
+	conn, err := s.ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+}
+
+// readUntil reads lines until one contains substr, failing the test after
+// 5s if it never shows up.
+func (s *fakeServer) readUntil(t *testing.T, substr string) string {
+	t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading from client: %v (wanted a line containing %q)", err, substr)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+}
+
+func (s *fakeServer) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var noop = handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {})
+
+// newTestNetwork returns an ircNetwork configured to dial srv, with sasl
+// configured if sasl != nil.
+func newTestNetwork(t *testing.T, srv *fakeServer, sasl *config.Sasl) *ircNetwork {
+	t.Helper()
+	host, portStr, err := net.SplitHostPort(srv.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIRCNetwork(config.Network{
+		Name:   "test",
+		Server: host,
+		Port:   port,
+		Nick:   "bot",
+		Sasl:   sasl,
+	})
+}
+
+// TestConnect_negotiatesCapAndSasl drives ircNetwork.connect against a fake
+// TCP server and asserts that it actually sends "CAP LS" on REGISTER and
+// "AUTHENTICATE" once the server grants the sasl capability: a regression
+// test for a handler that was wired up against an API the real goirc client
+// doesn't have, which meant none of this ever ran.
+func TestConnect_negotiatesCapAndSasl(t *testing.T) {
+	srv := newFakeServer(t)
+	n := newTestNetwork(t, srv, &config.Sasl{User: "bot", Pass: "hunter2"})
+
+	done := make(chan struct{})
+	go func() {
+		n.connect(noop)
+		close(done)
+	}()
+
+	srv.accept(t)
+	srv.readUntil(t, "CAP LS 302")
+
+	srv.send(t, ":irc.example CAP * LS :sasl server-time")
+	// sasl and server-time are requested as two separate CAP REQ lines, so
+	// that a server NAKing one doesn't also cost us the other.
+	srv.readUntil(t, "CAP REQ :server-time")
+	srv.readUntil(t, "CAP REQ :sasl")
+
+	srv.send(t, ":irc.example CAP bot ACK :sasl")
+	srv.readUntil(t, "AUTHENTICATE PLAIN")
+
+	srv.send(t, "AUTHENTICATE +")
+	srv.readUntil(t, "AUTHENTICATE ")
+
+	srv.send(t, ":irc.example 904 bot :SASL authentication failed")
+	srv.readUntil(t, "CAP END")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect() did not return after a fatal SASL failure")
+	}
+}
+
+// TestConnect_capNakOfSaslIsFatal asserts that a network with SASL
+// credentials configured gives up (rather than silently connecting
+// unauthenticated) when the server NAKs the sasl capability.
+func TestConnect_capNakOfSaslIsFatal(t *testing.T) {
+	srv := newFakeServer(t)
+	n := newTestNetwork(t, srv, &config.Sasl{User: "bot", Pass: "hunter2"})
+
+	type result struct {
+		connected, fatal bool
+		err              error
+	}
+	done := make(chan result, 1)
+	go func() {
+		connected, fatal, err := n.connect(noop)
+		done <- result{connected, fatal, err}
+	}()
+
+	srv.accept(t)
+	srv.readUntil(t, "CAP LS 302")
+	srv.send(t, ":irc.example CAP * LS :server-time")
+	srv.readUntil(t, "CAP REQ :sasl")
+
+	srv.send(t, ":irc.example CAP bot NAK :sasl")
+
+	select {
+	case r := <-done:
+		if !r.fatal {
+			t.Errorf("connect() fatal = false after a sasl NAK, want true")
+		}
+		if r.connected {
+			t.Errorf("connect() connected = true after a sasl NAK, want false")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connect() did not return after the server NAK'd sasl")
+	}
+}
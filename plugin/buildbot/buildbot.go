@@ -0,0 +1,25 @@
+// Package buildbot implements a Handler that turns decoded buildbot events
+// (delivered via /push_buildbot) into chat lines.
+package buildbot
+
+import (
+	"context"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+func init() {
+	handler.RegisterPlugin("buildbot", func(cfg interface{}) handler.Handler {
+		return New()
+	})
+}
+
+// New returns a Handler which announces Buildbot events and ignores every
+// other kind of Event.
+func New() handler.Handler {
+	return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+		if ev.Kind == handler.KindBuildbot && ev.Buildbot != nil {
+			w.Send(ev.Buildbot.AsChatLine())
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package buildbot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+type fakeWriter struct{ sent []string }
+
+func (w *fakeWriter) Send(line string)   { w.sent = append(w.sent, line) }
+func (w *fakeWriter) Notice(line string) { w.sent = append(w.sent, line) }
+
+type fakeBuildbotEvent struct{ line string }
+
+func (e fakeBuildbotEvent) AsChatLine() string { return e.line }
+
+func TestNew(t *testing.T) {
+	h := New()
+	w := &fakeWriter{}
+
+	h.Handle(context.Background(), w, &handler.Event{
+		Kind:     handler.KindBuildbot,
+		Buildbot: fakeBuildbotEvent{line: "build #42 of i3 succeeded"},
+	})
+
+	if len(w.sent) != 1 || w.sent[0] != "build #42 of i3 succeeded" {
+		t.Errorf("sent = %v, want a single buildbot chat line", w.sent)
+	}
+}
+
+func TestNew_ignoresOtherKinds(t *testing.T) {
+	h := New()
+	w := &fakeWriter{}
+
+	h.Handle(context.Background(), w, &handler.Event{Kind: handler.KindMessage, Text: "hello"})
+	h.Handle(context.Background(), w, &handler.Event{Kind: handler.KindCommit, Text: "a commit"})
+
+	if len(w.sent) != 0 {
+		t.Errorf("sent = %v, want nothing for non-buildbot events", w.sent)
+	}
+}
+
+func TestNew_ignoresNilBuildbot(t *testing.T) {
+	h := New()
+	w := &fakeWriter{}
+
+	h.Handle(context.Background(), w, &handler.Event{Kind: handler.KindBuildbot})
+
+	if len(w.sent) != 0 {
+		t.Errorf("sent = %v, want nothing when Buildbot is nil", w.sent)
+	}
+}
@@ -0,0 +1,29 @@
+// Package commitpush implements a Handler that announces commit summaries
+// pushed to /push_commit, one chat line per line of the request body.
+package commitpush
+
+import (
+	"context"
+	"strings"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+func init() {
+	handler.RegisterPlugin("commitpush", func(cfg interface{}) handler.Handler {
+		return New()
+	})
+}
+
+// New returns a Handler which announces commit push events and ignores
+// every other kind of Event.
+func New() handler.Handler {
+	return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+		if ev.Kind != handler.KindCommit {
+			return
+		}
+		for _, line := range strings.Split(ev.Text, "\n") {
+			w.Send(line)
+		}
+	})
+}
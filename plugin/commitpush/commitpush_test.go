@@ -0,0 +1,40 @@
+package commitpush
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+type fakeWriter struct{ sent []string }
+
+func (w *fakeWriter) Send(line string)   { w.sent = append(w.sent, line) }
+func (w *fakeWriter) Notice(line string) { w.sent = append(w.sent, line) }
+
+func TestNew(t *testing.T) {
+	h := New()
+	w := &fakeWriter{}
+
+	h.Handle(context.Background(), w, &handler.Event{
+		Kind: handler.KindCommit,
+		Text: "sven pushed 2 commits to i3\nfix build\nupdate docs",
+	})
+
+	want := []string{"sven pushed 2 commits to i3", "fix build", "update docs"}
+	if !reflect.DeepEqual(w.sent, want) {
+		t.Errorf("sent = %v, want %v", w.sent, want)
+	}
+}
+
+func TestNew_ignoresOtherKinds(t *testing.T) {
+	h := New()
+	w := &fakeWriter{}
+
+	h.Handle(context.Background(), w, &handler.Event{Kind: handler.KindMessage, Text: "hello"})
+
+	if len(w.sent) != 0 {
+		t.Errorf("sent = %v, want nothing for non-commit events", w.sent)
+	}
+}
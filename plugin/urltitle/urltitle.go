@@ -0,0 +1,95 @@
+// Package urltitle implements a Handler that looks for http:// URLs in
+// incoming chat lines and posts the target page's HTML <title> back to the
+// channel.
+package urltitle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/go-buildbot-announce/handler"
+)
+
+func init() {
+	handler.RegisterPlugin("urltitle", func(cfg interface{}) handler.Handler {
+		return New()
+	})
+}
+
+// This is naive, but hopefully good enough :)
+var urlRe = regexp.MustCompile("(http://(?:[^ ]*))")
+
+var titleRe = regexp.MustCompile("<title>(.*)</title>")
+
+// New returns a Handler which reacts to URLs mentioned in the Text of
+// KindMessage Events and ignores every other kind of Event.
+func New() handler.Handler {
+	return handler.HandlerFunc(func(ctx context.Context, w handler.MessageWriter, ev *handler.Event) {
+		if ev.Kind == handler.KindMessage {
+			for _, match := range urlRe.FindAllStringSubmatch(ev.Text, -1) {
+				go fetchTitle(w, match[1])
+			}
+		}
+	})
+}
+
+func fetchTitle(w handler.MessageWriter, url string) {
+	result := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			result <- nil
+			return
+		}
+		result <- resp
+	}()
+
+	go func() {
+		time.Sleep(10 * time.Second)
+		result <- nil
+	}()
+
+	resp := <-result
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Printf(`URL "%s", status %d`, url, resp.StatusCode)
+
+	// Check for the special case of a , or ) being the last character of the
+	// URL. This happens when the URL is used without leaving a whitespace
+	// between the text, for example in "hey, i followed the userguide
+	// (http://i3wm.org/docs/userguide.html) and it doesn’t work". We can’t
+	// always split on these characters since some pages (like spiegel.de) use
+	// strange characters in their normal URLs.
+	if resp.StatusCode == 404 &&
+		(strings.HasSuffix(url, ",") || strings.HasSuffix(url, ")")) {
+		fetchTitle(w, strings.TrimRight(url, ",)"))
+		return
+	}
+
+	if resp.StatusCode != 200 {
+		return
+	}
+
+	reader := bufio.NewReaderSize(resp.Body, 1*1024*1024)
+	for {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			log.Printf("Error reading HTTP response for %s: %s\n", url, err.Error())
+			return
+		}
+		matches := titleRe.FindSubmatch(line)
+		if len(matches) > 1 {
+			w.Send(fmt.Sprintf("[Link info] %s", string(matches[1])))
+			return
+		}
+	}
+}